@@ -0,0 +1,221 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jollheef/out-of-tree/config"
+)
+
+// distroDriver hides the per-distribution package manager quirks from
+// generateBaseDockerImage and kernelAutogenHandler so that adding a new
+// distribution does not require touching the generic build logic.
+type distroDriver interface {
+	// BaseDockerfile returns the Dockerfile lines (everything after
+	// FROM) needed to prepare a minimal out-of-tree build environment.
+	BaseDockerfile() string
+
+	// KernelPkgs lists the kernel image packages available in
+	// container whose name matches mask. If generic is set only
+	// generic (not hardware specific) kernels are returned.
+	KernelPkgs(container, mask string, generic bool) (pkgs []string, err error)
+
+	// InstallCmd returns the Dockerfile RUN line (newline-terminated)
+	// that installs the given kernel image package together with its
+	// headers.
+	InstallCmd(pkg string) string
+
+	// HeadersPkg derives the headers package name for a kernel image
+	// package name.
+	HeadersPkg(pkg string) string
+
+	// InitrdPath returns the path of the initrd/initramfs image that
+	// goes with the given kernel release.
+	InitrdPath(release string) string
+}
+
+func getDistroDriver(dt config.Distro) (d distroDriver, err error) {
+	switch dt {
+	case config.Ubuntu:
+		d = ubuntuDriver{}
+	case config.CentOS:
+		d = centosDriver{}
+	case config.Fedora:
+		d = fedoraDriver{}
+	case config.Arch:
+		d = archDriver{}
+	default:
+		err = fmt.Errorf("%s not yet supported", dt.String())
+	}
+	return
+}
+
+// searchPkgs runs cmd inside container and returns every substring of
+// its output matched by the pattern "prefix"+mask.
+func searchPkgs(container, cmd, prefix, mask string, generic bool, genericSuffix string) (pkgs []string, err error) {
+	c := dockerCommand(container, "/tmp", "1m", cmd)
+	rawOutput, err := c.CombinedOutput()
+	if err != nil {
+		return
+	}
+
+	return matchPkgs(rawOutput, prefix, mask, generic, genericSuffix)
+}
+
+// matchPkgs is the pure parsing half of searchPkgs, split out so the
+// package-name matching can be unit tested against recorded command
+// output without a container.
+func matchPkgs(rawOutput []byte, prefix, mask string, generic bool, genericSuffix string) (pkgs []string, err error) {
+	r, err := regexp.Compile(prefix + mask)
+	if err != nil {
+		return
+	}
+
+	for _, k := range r.FindAll(rawOutput, -1) {
+		pkg := string(k)
+		if generic && !strings.HasSuffix(pkg, genericSuffix) {
+			continue
+		}
+		pkgs = append(pkgs, pkg)
+	}
+
+	return
+}
+
+type ubuntuDriver struct{}
+
+func (ubuntuDriver) BaseDockerfile() string {
+	d := "ENV DEBIAN_FRONTEND=noninteractive\n"
+	d += "RUN apt-get update\n"
+	d += "RUN apt-get install -y build-essential libelf-dev\n"
+	d += "RUN apt-get install -y wget git\n"
+	return d
+}
+
+func (ubuntuDriver) KernelPkgs(container, mask string, generic bool) (pkgs []string, err error) {
+	cmd := "apt-cache search linux-image | cut -d ' ' -f 1"
+	return searchPkgs(container, cmd, "linux-image-", mask, generic, "generic")
+}
+
+func (ubuntuDriver) InstallCmd(pkg string) string {
+	return fmt.Sprintf("RUN apt-get install -y %s %s\n", pkg, pkg2headers(pkg))
+}
+
+func (ubuntuDriver) HeadersPkg(pkg string) string {
+	return pkg2headers(pkg)
+}
+
+func (ubuntuDriver) InitrdPath(release string) string {
+	return "/boot/initrd.img-" + release
+}
+
+func pkg2headers(pkg string) string {
+	return strings.Replace(pkg, "image", "headers", -1)
+}
+
+type centosDriver struct{}
+
+func (centosDriver) BaseDockerfile() string {
+	d := "RUN yum install -y yum-utils\n"
+	d += "RUN yum groupinstall -y 'Development Tools'\n"
+	d += "RUN yum install -y elfutils-libelf-devel wget git\n"
+	return d
+}
+
+func (centosDriver) KernelPkgs(container, mask string, generic bool) (pkgs []string, err error) {
+	// `yum --showduplicates list kernel` prints "kernel.<arch> <version> <repo>"
+	// per line; rejoin it as "kernel-<version>.<arch>" so it actually
+	// starts with the "kernel-" prefix searchPkgs matches against.
+	cmd := "yum --showduplicates list kernel | " +
+		"awk '{n=split($1,a,\".\"); print a[1]\"-\"$2\".\"a[n]}'"
+	return searchPkgs(container, cmd, "kernel-", mask, false, "")
+}
+
+func (centosDriver) InstallCmd(pkg string) string {
+	return fmt.Sprintf("RUN yum install -y %s %s\n", pkg, centosDriver{}.HeadersPkg(pkg))
+}
+
+func (centosDriver) HeadersPkg(pkg string) string {
+	return strings.Replace(pkg, "kernel-", "kernel-devel-", 1)
+}
+
+func (centosDriver) InitrdPath(release string) string {
+	return "/boot/initramfs-" + release + ".img"
+}
+
+type fedoraDriver struct{}
+
+func (fedoraDriver) BaseDockerfile() string {
+	d := "RUN dnf install -y dnf-plugins-core\n"
+	d += "RUN dnf groupinstall -y 'Development Tools'\n"
+	d += "RUN dnf install -y elfutils-libelf-devel wget git\n"
+	return d
+}
+
+func (fedoraDriver) KernelPkgs(container, mask string, generic bool) (pkgs []string, err error) {
+	// Same "name.arch version repo" layout as yum, see centosDriver.
+	cmd := "dnf --showduplicates list kernel | " +
+		"awk '{n=split($1,a,\".\"); print a[1]\"-\"$2\".\"a[n]}'"
+	return searchPkgs(container, cmd, "kernel-", mask, false, "")
+}
+
+func (fedoraDriver) InstallCmd(pkg string) string {
+	return fmt.Sprintf("RUN dnf install -y %s %s\n", pkg, fedoraDriver{}.HeadersPkg(pkg))
+}
+
+func (fedoraDriver) HeadersPkg(pkg string) string {
+	return strings.Replace(pkg, "kernel-", "kernel-devel-", 1)
+}
+
+func (fedoraDriver) InitrdPath(release string) string {
+	return "/boot/initramfs-" + release + ".img"
+}
+
+type archDriver struct{}
+
+func (archDriver) BaseDockerfile() string {
+	d := "RUN pacman -Sy --noconfirm\n"
+	d += "RUN pacman -S --noconfirm base-devel libelf wget git\n"
+	return d
+}
+
+// KernelPkgs ignores mask: unlike Ubuntu/CentOS/Fedora, Arch's "linux"
+// package name never embeds a version (the version is a separate pacman
+// field), so there is no per-release package to mask against. Arch
+// autogen only ever builds the current rolling kernel.
+func (archDriver) KernelPkgs(container, mask string, generic bool) (pkgs []string, err error) {
+	cmd := "pacman -Ss '^core/linux ' | head -n1 | cut -d ' ' -f 1 | cut -d '/' -f 2"
+	c := dockerCommand(container, "/tmp", "1m", cmd)
+	rawOutput, err := c.CombinedOutput()
+	if err != nil {
+		return
+	}
+
+	pkg := strings.TrimSpace(string(rawOutput))
+	if pkg == "" {
+		return
+	}
+
+	pkgs = []string{pkg}
+	return
+}
+
+func (archDriver) InstallCmd(pkg string) string {
+	return fmt.Sprintf("RUN pacman -S --noconfirm %s %s\n", pkg, archDriver{}.HeadersPkg(pkg))
+}
+
+func (archDriver) HeadersPkg(pkg string) string {
+	return pkg + "-headers"
+}
+
+func (archDriver) InitrdPath(release string) string {
+	// Arch does not name its initramfs per kernel release: the stock
+	// "linux" package always produces /boot/initramfs-linux.img (plus a
+	// -fallback.img), regardless of the running kernel release.
+	return "/boot/initramfs-linux.img"
+}
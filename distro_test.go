@@ -0,0 +1,80 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchPkgsCentosFedora(t *testing.T) {
+	// Output of the awk rewrite applied to
+	// `yum --showduplicates list kernel`/`dnf --showduplicates list kernel`.
+	rawOutput := []byte(
+		"kernel-3.10.0-1062.9.1.el7.x86_64\n" +
+			"kernel-3.10.0-1062.12.1.el7.x86_64\n",
+	)
+
+	pkgs, err := matchPkgs(rawOutput, "kernel-", "3.10.0.*", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"kernel-3.10.0-1062.9.1.el7.x86_64",
+		"kernel-3.10.0-1062.12.1.el7.x86_64",
+	}
+	if !reflect.DeepEqual(pkgs, want) {
+		t.Fatalf("got %v, want %v", pkgs, want)
+	}
+}
+
+func TestMatchPkgsCentosFedoraNoMatch(t *testing.T) {
+	// Regression check for the previous "kernel.x86_64-<version>" awk
+	// output, which never contained the literal "kernel-" prefix.
+	rawOutput := []byte("kernel.x86_64-3.10.0-1062.9.1.el7\n")
+
+	pkgs, err := matchPkgs(rawOutput, "kernel-", "3.10.0.*", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 0 {
+		t.Fatalf("expected no matches against the old broken format, got %v", pkgs)
+	}
+}
+
+func TestMatchPkgsUbuntuGeneric(t *testing.T) {
+	rawOutput := []byte(
+		"linux-image-4.15.0-29-generic\n" +
+			"linux-image-4.15.0-29-lowlatency\n",
+	)
+
+	pkgs, err := matchPkgs(rawOutput, "linux-image-", "4.15.0.*", true, "generic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"linux-image-4.15.0-29-generic"}
+	if !reflect.DeepEqual(pkgs, want) {
+		t.Fatalf("got %v, want %v", pkgs, want)
+	}
+}
+
+func TestArchHeadersPkg(t *testing.T) {
+	// Arch's "linux" package name never embeds a version, so the
+	// headers package is always exactly "linux-headers" - never
+	// "linux-headers-headers" from running HeadersPkg on the headers
+	// package itself.
+	if got := (archDriver{}).HeadersPkg("linux"); got != "linux-headers" {
+		t.Fatalf("HeadersPkg(%q) = %q, want %q", "linux", got, "linux-headers")
+	}
+}
+
+func TestArchInstallCmd(t *testing.T) {
+	want := "RUN pacman -S --noconfirm linux linux-headers\n"
+	if got := (archDriver{}).InstallCmd("linux"); got != want {
+		t.Fatalf("InstallCmd(%q) = %q, want %q", "linux", got, want)
+	}
+}
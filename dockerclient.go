@@ -0,0 +1,232 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+var (
+	dockerClientOnce sync.Once
+	dockerClientInst *client.Client
+	dockerClientErr  error
+)
+
+// dockerClient returns a lazily initialized, API-version-negotiated
+// Docker Engine API client shared by the whole package.
+func dockerClient() (cli *client.Client, err error) {
+	dockerClientOnce.Do(func() {
+		dockerClientInst, dockerClientErr = client.NewClientWithOpts(
+			client.FromEnv, client.WithAPIVersionNegotiation())
+	})
+	return dockerClientInst, dockerClientErr
+}
+
+// dockerfileTar wraps a single Dockerfile's contents into an in-memory
+// tar archive suitable as an ImageBuild context, so nothing is ever
+// written to ~/.out-of-tree.
+func dockerfileTar(dockerfile string) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	hdr := &tar.Header{
+		Name: "Dockerfile",
+		Mode: 0644,
+		Size: int64(len(dockerfile)),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write([]byte(dockerfile)); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// buildDockerImage builds dockerfile as tag using the Docker Engine API,
+// streaming the build progress to stdout as it arrives (instead of
+// buffering the whole response) and returning an error as soon as the
+// stream reports one.
+func buildDockerImage(tag, dockerfile string) (err error) {
+	cli, err := dockerClient()
+	if err != nil {
+		return
+	}
+
+	buildCtx, err := dockerfileTar(dockerfile)
+	if err != nil {
+		return
+	}
+
+	resp, err := cli.ImageBuild(context.Background(), buildCtx, types.ImageBuildOptions{
+		Tags:       []string{tag},
+		Dockerfile: "Dockerfile",
+		Remove:     true,
+	})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	return jsonmessage.DisplayJSONMessagesStream(resp.Body, os.Stdout, 0, false, nil)
+}
+
+// dockerImageExists reports whether tag is already present locally.
+func dockerImageExists(tag string) bool {
+	cli, err := dockerClient()
+	if err != nil {
+		return false
+	}
+
+	_, _, err = cli.ImageInspectWithRaw(context.Background(), tag)
+	return err == nil
+}
+
+// imageHistoryText concatenates the "created by" field of every layer
+// of tag, so callers can check whether a package is already installed
+// without keeping a local copy of the Dockerfile.
+func imageHistoryText(tag string) (history string, err error) {
+	cli, err := dockerClient()
+	if err != nil {
+		return
+	}
+
+	items, err := cli.ImageHistory(context.Background(), tag)
+	if err != nil {
+		return
+	}
+
+	var b strings.Builder
+	for _, item := range items {
+		b.WriteString(item.CreatedBy)
+		b.WriteString("\n")
+	}
+
+	history = b.String()
+	return
+}
+
+// createKickContainer creates and starts a throwaway container from
+// image and returns its ID once it has finished running.
+func createKickContainer(image string) (containerID string, err error) {
+	cli, err := dockerClient()
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+		Image: image,
+		Cmd:   []string{"bash", "-c", "ls"},
+	}, nil, nil, nil, "")
+	if err != nil {
+		return
+	}
+	containerID = resp.ID
+
+	err = cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+	if err != nil {
+		return
+	}
+
+	statusCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case cerr := <-errCh:
+		err = cerr
+	case <-statusCh:
+	}
+
+	return
+}
+
+// copyFromContainer streams srcPath out of containerID and extracts it
+// into destDir.
+func copyFromContainer(containerID, srcPath, destDir string) (err error) {
+	cli, err := dockerClient()
+	if err != nil {
+		return
+	}
+
+	reader, _, err := cli.CopyFromContainer(context.Background(), containerID, srcPath)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	return extractTar(reader, destDir)
+}
+
+// extractTar writes the tar stream r into destDir, stripping only the
+// single leading path component docker adds (e.g. "boot/") and
+// recreating the rest of the directory structure underneath, so files
+// like boot/grub/grub.cfg land at destDir/grub/grub.cfg instead of
+// colliding with same-named files from other /boot subdirectories.
+func extractTar(r io.Reader, destDir string) (err error) {
+	tr := tar.NewReader(r)
+
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		rel := hdr.Name
+		if idx := strings.Index(rel, "/"); idx != -1 {
+			rel = rel[idx+1:]
+		}
+		if rel == "" || rel == "." {
+			continue
+		}
+
+		dst := filepath.Join(destDir, rel)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dst, os.FileMode(hdr.Mode))
+			if err != nil {
+				return
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(dst), 0755)
+			if err != nil {
+				return
+			}
+
+			var f *os.File
+			f, err = os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return
+			}
+
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
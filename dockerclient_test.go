@@ -0,0 +1,70 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTarPreservesSubdirectories(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	files := map[string]string{
+		"boot/vmlinuz-4.15.0-29-generic": "vmlinuz",
+		"boot/grub/grub.cfg":             "grub config",
+		"boot/efi/grub.cfg":              "efi grub config",
+	}
+
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name: name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := t.TempDir()
+	if err := extractTar(&buf, destDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		rel := name[len("boot/"):]
+		got, err := os.ReadFile(filepath.Join(destDir, rel))
+		if err != nil {
+			t.Fatalf("reading %s: %v", rel, err)
+		}
+		if string(got) != content {
+			t.Fatalf("%s: got %q, want %q", rel, got, content)
+		}
+	}
+
+	// The two grub.cfg files must not have clobbered each other.
+	grub, err := os.ReadFile(filepath.Join(destDir, "grub", "grub.cfg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	efiGrub, err := os.ReadFile(filepath.Join(destDir, "efi", "grub.cfg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(grub) == string(efiGrub) {
+		t.Fatal("boot/grub/grub.cfg and boot/efi/grub.cfg ended up with the same content")
+	}
+}
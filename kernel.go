@@ -7,13 +7,12 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"os/user"
-	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/jollheef/out-of-tree/config"
 )
@@ -28,250 +27,323 @@ func kernelListHandler(kcfg config.KernelConfig) (err error) {
 	return
 }
 
-func matchDebianKernelPkg(container, mask string, generic bool) (pkgs []string,
-	err error) {
+func generateBaseDockerImage(sk config.KernelMask) (err error) {
+	tag := sk.DockerName()
 
-	cmd := "apt-cache search linux-image | cut -d ' ' -f 1"
-	c := dockerCommand(container, "/tmp", "1m", cmd)
-	rawOutput, err := c.CombinedOutput()
-	if err != nil {
+	if dockerImageExists(tag) {
+		log.Printf("Base image for %s:%s found",
+			sk.DistroType.String(), sk.DistroRelease)
 		return
 	}
 
-	r, err := regexp.Compile("linux-image-" + mask)
+	log.Printf("Base image for %s:%s not found, start generating",
+		sk.DistroType.String(), sk.DistroRelease)
+
+	driver, err := getDistroDriver(sk.DistroType)
 	if err != nil {
 		return
 	}
 
-	kernels := r.FindAll(rawOutput, -1)
-
-	for _, k := range kernels {
-		pkg := string(k)
-		if generic && !strings.HasSuffix(pkg, "generic") {
-			continue
-		}
-		pkgs = append(pkgs, pkg)
-	}
-
-	return
-}
+	d := fmt.Sprintf("FROM %s:%s\n",
+		strings.ToLower(sk.DistroType.String()),
+		sk.DistroRelease,
+	)
+	d += driver.BaseDockerfile()
 
-func dockerImagePath(sk config.KernelMask) (path string, err error) {
-	usr, err := user.Current()
+	err = buildDockerImage(tag, d)
 	if err != nil {
+		log.Printf("Base image for %s:%s generating error, see log",
+			sk.DistroType.String(), sk.DistroRelease)
+		log.Println(err)
 		return
 	}
 
-	path = usr.HomeDir + "/.out-of-tree/"
-	path += sk.DistroType.String() + "/" + sk.DistroRelease
+	log.Printf("Base image for %s:%s generating success",
+		sk.DistroType.String(), sk.DistroRelease)
+
 	return
 }
 
-func generateBaseDockerImage(sk config.KernelMask) (err error) {
-	imagePath, err := dockerImagePath(sk)
+// dockerImageAppend adds every kernel package in pkgnames that is not
+// already installed in the image (checked via its build history, so no
+// Dockerfile needs to be kept around) and rebuilds it once, so a whole
+// batch of kernels only costs a single extra layer/build instead of one
+// rebuild per package.
+func dockerImageAppend(sk config.KernelMask, pkgnames []string) (err error) {
+	tag := sk.DockerName()
+
+	driver, err := getDistroDriver(sk.DistroType)
 	if err != nil {
 		return
 	}
-	dockerPath := imagePath + "/Dockerfile"
-
-	d := "# BASE\n"
 
-	if exists(dockerPath) {
-		log.Printf("Base image for %s:%s found",
-			sk.DistroType.String(), sk.DistroRelease)
+	history, err := imageHistoryText(tag)
+	if err != nil {
 		return
-	} else {
-		log.Printf("Base image for %s:%s not found, start generating",
-			sk.DistroType.String(), sk.DistroRelease)
-		os.MkdirAll(imagePath, os.ModePerm)
 	}
 
-	d += fmt.Sprintf("FROM %s:%s\n",
-		strings.ToLower(sk.DistroType.String()),
-		sk.DistroRelease,
-	)
+	var toInstall []string
+	for _, pkgname := range pkgnames {
+		if strings.Contains(history, pkgname) {
+			// already installed kernel
+			log.Printf("kernel %s for %s:%s is already exists",
+				pkgname, sk.DistroType.String(), sk.DistroRelease)
+			continue
+		}
+		toInstall = append(toInstall, pkgname)
+	}
 
-	switch sk.DistroType {
-	case config.Ubuntu:
-		d += "ENV DEBIAN_FRONTEND=noninteractive\n"
-		d += "RUN apt-get update\n"
-		d += "RUN apt-get install -y build-essential libelf-dev\n"
-		d += "RUN apt-get install -y wget git\n"
-	default:
-		s := fmt.Sprintf("%s not yet supported", sk.DistroType.String())
-		err = errors.New(s)
+	if len(toInstall) == 0 {
 		return
 	}
 
-	d += "# END BASE\n\n"
+	log.Printf("Start adding kernels %s for %s:%s",
+		strings.Join(toInstall, ", "), sk.DistroType.String(), sk.DistroRelease)
 
-	err = ioutil.WriteFile(dockerPath, []byte(d), 0644)
-	if err != nil {
-		return
+	// Join every package's install command into one RUN line, so the
+	// whole batch lands in a single layer.
+	var cmds []string
+	for _, pkgname := range toInstall {
+		cmd := strings.TrimSuffix(driver.InstallCmd(pkgname), "\n")
+		cmds = append(cmds, strings.TrimPrefix(cmd, "RUN "))
 	}
+	d := fmt.Sprintf("FROM %s\nRUN %s\n", tag, strings.Join(cmds, " && "))
 
-	cmd := exec.Command("docker", "build", "-t", sk.DockerName(), imagePath)
-	rawOutput, err := cmd.CombinedOutput()
+	err = buildDockerImage(tag, d)
 	if err != nil {
-		log.Printf("Base image for %s:%s generating error, see log",
-			sk.DistroType.String(), sk.DistroRelease)
-		log.Println(string(rawOutput))
+		log.Printf("Add kernels %s for %s:%s error, see log",
+			strings.Join(toInstall, ", "), sk.DistroType.String(), sk.DistroRelease)
+		log.Println(err)
 		return
 	}
 
-	log.Printf("Base image for %s:%s generating success",
-		sk.DistroType.String(), sk.DistroRelease)
+	log.Printf("Add kernels %s for %s:%s success",
+		strings.Join(toInstall, ", "), sk.DistroType.String(), sk.DistroRelease)
 
 	return
 }
 
-func dockerImageAppend(sk config.KernelMask, pkgname string) (err error) {
-	imagePath, err := dockerImagePath(sk)
-	if err != nil {
-		return
-	}
+// keyedMutex hands out a lock per string key, so unrelated images never
+// block each other while operations on the same image are serialized.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
 
-	raw, err := ioutil.ReadFile(imagePath + "/Dockerfile")
-	if err != nil {
-		return
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*sync.Mutex)
 	}
-
-	if strings.Contains(string(raw), pkgname) {
-		// already installed kernel
-		log.Printf("kernel %s for %s:%s is already exists",
-			pkgname, sk.DistroType.String(), sk.DistroRelease)
-		return
+	l, ok := k.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		k.locks[key] = l
 	}
+	k.mu.Unlock()
 
-	log.Printf("Start adding kernel %s for %s:%s",
-		pkgname, sk.DistroType.String(), sk.DistroRelease)
+	l.Lock()
+	return l.Unlock
+}
 
-	//s := fmt.Sprintf("RUN apt-get install -y %s %s\n", pkgname,
-	s := fmt.Sprintf("RUN apt-get install -y %s %s\n", pkgname,
-		strings.Replace(pkgname, "image", "headers", -1))
+// dockerImageLock serializes every step that reads-then-writes a given
+// image tag (build + append, and kick + copy) per DockerName(), so two
+// SupportedKernels entries that resolve to the same image never race
+// each other, e.g. both deciding which packages are missing from the
+// same stale image history and clobbering each other's rebuild.
+var dockerImageLock keyedMutex
+
+// kickImage runs image once so its filesystem reflects a freshly
+// installed kernel, returning the container ID to copy files from.
+func kickImage(image string) (containerID string, err error) {
+	return createKickContainer(image)
+}
 
-	err = ioutil.WriteFile(imagePath+"/Dockerfile",
-		append(raw, []byte(s)...), 0644)
+// copyKernels copies /boot out of containerID into ~/.out-of-tree/kernels.
+func copyKernels(containerID string) (err error) {
+	usr, err := user.Current()
 	if err != nil {
 		return
 	}
 
-	cmd := exec.Command("docker", "build", "-t", sk.DockerName(), imagePath)
-	rawOutput, err := cmd.CombinedOutput()
-	if err != nil {
-		// Fallback to previous state
-		werr := ioutil.WriteFile(imagePath+"/Dockerfile", raw, 0644)
-		if werr != nil {
-			return
-		}
-
-		log.Printf("Add kernel %s for %s:%s error, see log",
-			pkgname, sk.DistroType.String(), sk.DistroRelease)
-		log.Println(string(rawOutput))
-		return
+	target := usr.HomeDir + "/.out-of-tree/kernels/"
+	if !exists(target) {
+		os.MkdirAll(target, os.ModePerm)
 	}
 
-	log.Printf("Add kernel %s for %s:%s success",
-		pkgname, sk.DistroType.String(), sk.DistroRelease)
-
-	return
+	return copyFromContainer(containerID, "/boot", target)
 }
 
-func kickImage(name string) (err error) {
-	cmd := exec.Command("docker", "run", name, "bash", "-c", "ls")
-	_, err = cmd.CombinedOutput()
-	return
-}
+// buildKernelImage generates (or reuses) the base image for sk, searches
+// it for kernel packages matching sk.ReleaseMask and appends all of them
+// to the image in a single batch. Locked per DockerName() since two
+// SupportedKernels entries (e.g. differing only in ReleaseMask) can
+// resolve to the same image.
+func buildKernelImage(sk config.KernelMask) (err error) {
+	defer dockerImageLock.Lock(sk.DockerName())()
 
-func copyKernels(name string) (err error) {
-	cmd := exec.Command("docker", "ps", "-a")
-	rawOutput, err := cmd.CombinedOutput()
+	err = generateBaseDockerImage(sk)
 	if err != nil {
-		log.Println(string(rawOutput))
 		return
 	}
 
-	r, err := regexp.Compile(".*" + name)
+	driver, err := getDistroDriver(sk.DistroType)
 	if err != nil {
 		return
 	}
 
-	var containerID string
-
-	what := r.FindAll(rawOutput, -1)
-	for _, w := range what {
-		containerID = strings.Fields(string(w))[0]
-		break
-	}
-
-	usr, err := user.Current()
+	pkgs, err := driver.KernelPkgs(sk.DockerName(), sk.ReleaseMask, true)
 	if err != nil {
 		return
 	}
 
-	target := usr.HomeDir + "/.out-of-tree/kernels/"
-	if !exists(target) {
-		os.MkdirAll(target, os.ModePerm)
+	return dockerImageAppend(sk, pkgs)
+}
+
+// kickAndExtract runs ui, copies its kernels out and extracts their
+// config.KernelInfo. Concurrent calls for the same image name are
+// serialized through dockerImageLock.
+func kickAndExtract(ui string, sk config.KernelMask) (kernels []config.KernelInfo, err error) {
+	defer dockerImageLock.Lock(ui)()
+
+	containerID, err := kickImage(ui)
+	if err != nil {
+		return
 	}
 
-	cmd = exec.Command("docker", "cp", containerID+":/boot/.", target)
-	rawOutput, err = cmd.CombinedOutput()
+	err = copyKernels(containerID)
 	if err != nil {
-		log.Println(string(rawOutput))
 		return
 	}
 
-	return
+	return extractKernelInfo(ui, sk)
+}
+
+// kernelAutogenWorkers bounds how many images kernelAutogenHandler builds
+// and extracts concurrently. Zero, the default, means runtime.NumCPU().
+// It changes only through SetKernelAutogenWorkers; no command-line flag
+// sets it.
+var kernelAutogenWorkers int
+
+// SetKernelAutogenWorkers overrides the default kernelAutogenHandler
+// worker pool size.
+func SetKernelAutogenWorkers(n int) {
+	kernelAutogenWorkers = n
 }
 
+// kernelAutogenHandler builds every kernel listed in the project's
+// .out-of-tree.toml as a Docker image and extracts the kernels it finds
+// into kernels.toml. Up to kernelAutogenWorkers images are built/
+// extracted at once; kernelAutogenWorkers <= 0 defaults to
+// runtime.NumCPU().
 func kernelAutogenHandler(kcfg config.KernelConfig, workPath string) (err error) {
 	ka, err := config.ReadArtifactConfig(workPath + "/.out-of-tree.toml")
 	if err != nil {
 		return
 	}
 
-	var usedImages []string
-
 	for _, sk := range ka.SupportedKernels {
 		if sk.DistroRelease == "" {
-			err = errors.New("Please set distro_release")
-			return
+			return errors.New("Please set distro_release")
 		}
+	}
 
-		err = generateBaseDockerImage(sk)
-		if err != nil {
-			return
-		}
+	workers := kernelAutogenWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
 
-		var pkgs []string
-		pkgs, err = matchDebianKernelPkg(sk.DockerName(),
-			sk.ReleaseMask, true)
-		if err != nil {
-			return
-		}
+	sem := make(chan struct{}, workers)
 
-		for _, pkg := range pkgs {
-			dockerImageAppend(sk, pkg)
-		}
+	type buildResult struct {
+		sk  config.KernelMask
+		err error
+	}
+
+	results := make(chan buildResult, len(ka.SupportedKernels))
 
-		usedImages = append(usedImages, sk.DockerName())
+	var wg sync.WaitGroup
+	for _, sk := range ka.SupportedKernels {
+		sk := sk
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results <- buildResult{sk, buildKernelImage(sk)}
+		}()
 	}
+	wg.Wait()
+	close(results)
 
-	for _, ui := range usedImages {
-		err = kickImage(ui)
-		if err != nil {
-			log.Println("kick image", ui, ":", err)
+	var usedImages []string
+	seenImages := make(map[string]bool)
+	for r := range results {
+		if r.err != nil {
+			log.Println("build image", r.sk.DockerName(), ":", r.err)
 			continue
 		}
+		// Several SupportedKernels entries (e.g. differing only in
+		// ReleaseMask) may resolve to the same DockerName(); only
+		// kick/copy/extract it once.
+		name := r.sk.DockerName()
+		if seenImages[name] {
+			continue
+		}
+		seenImages[name] = true
+		usedImages = append(usedImages, name)
+	}
+
+	type extractResult struct {
+		kernels []config.KernelInfo
+		err     error
+	}
+
+	extracted := make(chan extractResult, len(usedImages))
+
+	for _, ui := range usedImages {
+		ui := ui
+		sk := maskByDockerName(ka.SupportedKernels, ui)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			kernels, kerr := kickAndExtract(ui, sk)
+			extracted <- extractResult{kernels, kerr}
+		}()
+	}
+	wg.Wait()
+	close(extracted)
 
-		err = copyKernels(ui)
-		if err != nil {
-			log.Println("copy kernels", ui, ":", err)
+	var kernels []config.KernelInfo
+	for r := range extracted {
+		if r.err != nil {
+			log.Println("kick/copy/extract:", r.err)
 			continue
 		}
+		kernels = append(kernels, r.kernels...)
+	}
+
+	path, err := kernelsConfigPath()
+	if err != nil {
+		return
+	}
+
+	err = mergeKernelsToml(path, kernels)
+	if err != nil {
+		return
 	}
 
-	log.Println("Currently generation of kernels.toml is not implemented")
-	log.Println("So next step is up to you hand :)")
+	log.Printf("%s updated with %d kernel(s)", path, len(kernels))
 	return
 }
+
+func maskByDockerName(masks []config.KernelMask, name string) config.KernelMask {
+	for _, sk := range masks {
+		if sk.DockerName() == name {
+			return sk
+		}
+	}
+	return config.KernelMask{}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jollheef/out-of-tree/config"
+)
+
+func kernelsConfigPath() (path string, err error) {
+	usr, err := user.Current()
+	if err != nil {
+		return
+	}
+	path = usr.HomeDir + "/.out-of-tree/kernels.toml"
+	return
+}
+
+// extractKernelInfo lists /lib/modules inside container and returns one
+// config.KernelInfo per kernel release found there. ConfigPath and
+// InitrdPath are derived from the release name; /boot is not inspected,
+// so those files are not checked to exist.
+func extractKernelInfo(container string, sk config.KernelMask) (kernels []config.KernelInfo, err error) {
+	cmd := dockerCommand(container, "/tmp", "1m", "ls /lib/modules 2>/dev/null")
+	rawOutput, err := cmd.CombinedOutput()
+	if err != nil {
+		return
+	}
+
+	archCmd := dockerCommand(container, "/tmp", "1m", "uname -m")
+	archOutput, aerr := archCmd.CombinedOutput()
+	arch := "x86_64"
+	if aerr == nil {
+		arch = strings.TrimSpace(string(archOutput))
+	}
+
+	driver, err := getDistroDriver(sk.DistroType)
+	if err != nil {
+		return
+	}
+
+	for _, release := range strings.Fields(string(rawOutput)) {
+		version := release
+		if idx := strings.Index(release, "-"); idx != -1 {
+			version = release[:idx]
+		}
+
+		kernels = append(kernels, config.KernelInfo{
+			DistroType:    sk.DistroType,
+			DistroRelease: sk.DistroRelease,
+			KernelRelease: release,
+			KernelVersion: version,
+			Arch:          arch,
+			ConfigPath:    "/boot/config-" + release,
+			InitrdPath:    driver.InitrdPath(release),
+			ContainerName: sk.DockerName(),
+		})
+	}
+
+	return
+}
+
+type kernelsFile struct {
+	Kernels []config.KernelInfo
+}
+
+func kernelKey(k config.KernelInfo) string {
+	return k.KernelRelease + "_" + k.DistroRelease
+}
+
+// mergeKernelsToml merges newly discovered kernels into the kernels.toml
+// at path, preserving any existing (e.g. manually authored) entries and
+// only adding kernels not already present by
+// KernelRelease+DistroRelease. The merged list is written back sorted by
+// DistroRelease, then KernelRelease, so existing entries may move.
+func mergeKernelsToml(path string, newKernels []config.KernelInfo) (err error) {
+	var kf kernelsFile
+	if exists(path) {
+		_, err = toml.DecodeFile(path, &kf)
+		if err != nil {
+			return
+		}
+	}
+
+	present := make(map[string]bool)
+	for _, k := range kf.Kernels {
+		present[kernelKey(k)] = true
+	}
+
+	for _, k := range newKernels {
+		key := kernelKey(k)
+		if present[key] {
+			continue
+		}
+		present[key] = true
+		kf.Kernels = append(kf.Kernels, k)
+	}
+
+	sort.Slice(kf.Kernels, func(i, j int) bool {
+		if kf.Kernels[i].DistroRelease != kf.Kernels[j].DistroRelease {
+			return kf.Kernels[i].DistroRelease < kf.Kernels[j].DistroRelease
+		}
+		return kf.Kernels[i].KernelRelease < kf.Kernels[j].KernelRelease
+	})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return toml.NewEncoder(f).Encode(kf)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Mikhail Klementev. All rights reserved.
+// Use of this source code is governed by a AGPLv3 license
+// (or later) that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jollheef/out-of-tree/config"
+)
+
+func TestMergeKernelsTomlDedupesByReleaseKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kernels.toml")
+
+	kernel := []config.KernelInfo{
+		{
+			DistroType:    config.Ubuntu,
+			DistroRelease: "18.04",
+			KernelRelease: "4.15.0-29-generic",
+		},
+	}
+
+	if err := mergeKernelsToml(path, kernel); err != nil {
+		t.Fatal(err)
+	}
+
+	// Merging the exact same KernelRelease+DistroRelease again must not
+	// duplicate the entry.
+	if err := mergeKernelsToml(path, kernel); err != nil {
+		t.Fatal(err)
+	}
+
+	var kf kernelsFile
+	if _, err := toml.DecodeFile(path, &kf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kf.Kernels) != 1 {
+		t.Fatalf("got %d kernels after re-merging the same entry, want 1: %+v",
+			len(kf.Kernels), kf.Kernels)
+	}
+}
+
+func TestMergeKernelsTomlPreservesHandAuthoredEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kernels.toml")
+
+	handAuthored := []config.KernelInfo{
+		{
+			DistroType:    config.Ubuntu,
+			DistroRelease: "16.04",
+			KernelRelease: "4.4.0-21-generic",
+			ContainerName: "manually-added",
+		},
+	}
+	if err := mergeKernelsToml(path, handAuthored); err != nil {
+		t.Fatal(err)
+	}
+
+	discovered := []config.KernelInfo{
+		{
+			DistroType:    config.Ubuntu,
+			DistroRelease: "18.04",
+			KernelRelease: "4.15.0-29-generic",
+		},
+	}
+	if err := mergeKernelsToml(path, discovered); err != nil {
+		t.Fatal(err)
+	}
+
+	var kf kernelsFile
+	if _, err := toml.DecodeFile(path, &kf); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(kf.Kernels) != 2 {
+		t.Fatalf("got %d kernels, want the hand-authored entry plus the discovered one: %+v",
+			len(kf.Kernels), kf.Kernels)
+	}
+
+	var sawHandAuthored bool
+	for _, k := range kf.Kernels {
+		if k.ContainerName == "manually-added" {
+			sawHandAuthored = true
+		}
+	}
+	if !sawHandAuthored {
+		t.Fatal("hand-authored kernel entry did not survive the merge")
+	}
+}